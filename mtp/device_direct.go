@@ -1,8 +1,7 @@
 package mtp
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -37,6 +36,13 @@ type DeviceDirect struct {
 	SeparateHeader bool
 
 	session *sessionData
+
+	// transport carries sendReq/fetchPacket/bulkRead/bulkWrite's actual
+	// USB traffic. It's set up in Open once sendEP/fetchEP/eventEP are
+	// known. The field is unexported, so only code inside package mtp can
+	// replace it; mtp/mtptest imports mtp, so its FakeTransport cannot be
+	// used from package mtp's own tests.
+	transport Transport
 }
 
 func (d *DeviceDirect) fetchMaxPacketSize() int {
@@ -58,8 +64,8 @@ func (d *DeviceDirect) Close() error {
 		req.Code = OC_CloseSession
 		// RunTransaction runs close, so can't use CloseSession().
 
-		if err := d.runTransaction(&req, &rep, nil, nil, 0); err != nil {
-			err := d.h.Reset()
+		if err := d.txIO().runTransaction(context.Background(), &req, &rep, nil, nil, 0); err != nil {
+			err := d.transport.Reset()
 			if d.Debug.USB {
 				log.USB.Debugf("reset, err: %v", err)
 			}
@@ -72,7 +78,7 @@ func (d *DeviceDirect) Close() error {
 			log.USB.Debugf("releaseInterface 0x%x, err: %v", d.ifaceDescr.InterfaceNumber, err)
 		}
 	}
-	err := d.h.Close()
+	err := d.transport.Close()
 	d.h = nil
 
 	if d.Debug.USB {
@@ -129,6 +135,14 @@ func (d *DeviceDirect) Open() error {
 		return fmt.Errorf("failed to claim: %w", err)
 	}
 
+	d.transport = &LibusbTransport{
+		h:       d.h,
+		dev:     d.dev,
+		sendEP:  d.sendEP,
+		fetchEP: d.fetchEP,
+		eventEP: d.eventEP,
+	}
+
 	if d.ifaceDescr.InterfaceStringIndex == 0 {
 		// Some of the win8phones have no interface field.
 		info := DeviceInfo{}
@@ -195,76 +209,18 @@ func (d *DeviceDirect) ID() (ID, error) {
 	return ID{Manufacturer: m, Product: p, SerialNumber: s}, nil
 }
 
-func (d *DeviceDirect) sendReq(req *Container) error {
-	c := usbBulkContainer{
-		usbBulkHeader: usbBulkHeader{
-			Length:        uint32(usbHdrLen + 4*len(req.Param)),
-			Type:          USB_CONTAINER_COMMAND,
-			Code:          req.Code,
-			TransactionID: req.TransactionID,
-		},
-	}
-	for i := range req.Param {
-		c.Param[i] = req.Param[i]
-	}
-
-	var wData [usbBulkLen]byte
-	buf := bytes.NewBuffer(wData[:0])
-
-	binary.Write(buf, binary.LittleEndian, c.usbBulkHeader)
-	if err := binary.Write(buf, binary.LittleEndian, c.Param[:len(req.Param)]); err != nil {
-		panic(err)
-	}
-
-	d.dataPrint(d.sendEP, buf.Bytes())
-	_, err := d.h.BulkTransfer(d.sendEP, buf.Bytes(), d.Timeout)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-// Fetches one USB packet. The header is split off, and the remainder is returned.
-// dest should be at least 512bytes.
-func (d *DeviceDirect) fetchPacket(dest []byte, header *usbBulkHeader) (rest []byte, err error) {
-	n, err := d.h.BulkTransfer(d.fetchEP, dest[:d.fetchMaxPacketSize()], d.Timeout)
-	if n > 0 {
-		d.dataPrint(d.fetchEP, dest[:n])
-	}
-
-	if err != nil {
-		return nil, err
-	}
-
-	buf := bytes.NewBuffer(dest[:n])
-	if err = binary.Read(buf, binary.LittleEndian, header); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
-}
-
-func (d *DeviceDirect) decodeRep(h *usbBulkHeader, rest []byte, rep *Container) error {
-	if h.Type != USB_CONTAINER_RESPONSE {
-		return SyncError(fmt.Sprintf("got type %d (%s) in response, want CONTAINER_RESPONSE.", h.Type, USB_names[int(h.Type)]))
-	}
-
-	rep.Code = h.Code
-	rep.TransactionID = h.TransactionID
-
-	restLen := int(h.Length) - usbHdrLen
-	if restLen > len(rest) {
-		return fmt.Errorf("header specified 0x%x bytes, but have 0x%x",
-			restLen, len(rest))
-	}
-	nParam := restLen / 4
-	for i := 0; i < nParam; i++ {
-		rep.Param = append(rep.Param, byteOrder.Uint32(rest[4*i:]))
-	}
-
-	if rep.Code != RC_OK {
-		return RCError(rep.Code)
+// txIO builds the shared transaction state machine's view of this
+// device. Called fresh per transaction since d.session changes across
+// OpenSession/CloseSession calls.
+func (d *DeviceDirect) txIO() *transactionIO {
+	return &transactionIO{
+		transport:      d.transport,
+		session:        d.session,
+		debug:          d.Debug,
+		separateHeader: d.SeparateHeader,
+		logSend:        func(data []byte) { d.dataPrint(d.sendEP, data) },
+		logFetch:       func(data []byte) { d.dataPrint(d.fetchEP, data) },
 	}
-	return nil
 }
 
 func (d *DeviceDirect) RunTransactionWithNoParams(code uint16) error {
@@ -285,15 +241,35 @@ func (d *DeviceDirect) RunTransactionWithNoParams(code uint16) error {
 // IDs, USB errors (BUSY, IO, ACCESS etc.), and receiving data for
 // operations that expect no data.
 func (d *DeviceDirect) RunTransaction(req *Container, rep *Container,
+	dest io.Writer, src io.Reader, writeSize int64) error {
+	ctx := context.Background()
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(d.Timeout)*time.Millisecond)
+		defer cancel()
+	}
+	return d.RunTransactionContext(ctx, req, rep, dest, src, writeSize)
+}
+
+// RunTransactionContext is like RunTransaction, but ctx governs
+// cancellation instead of d.Timeout. The transaction runs synchronously
+// on the calling goroutine: d.transport's BulkOut/BulkIn are handed ctx
+// directly. DeviceDirect's transport is a LibusbTransport, which turns
+// ctx's deadline into each transfer's timeout and starts no transfer
+// once ctx is done, but cannot abort a transfer that is already in
+// flight when ctx is cancelled. There is no separate
+// goroutine racing d.Close() against an in-flight transfer on this
+// device's own state.
+func (d *DeviceDirect) RunTransactionContext(ctx context.Context, req *Container, rep *Container,
 	dest io.Writer, src io.Reader, writeSize int64) error {
 	if d.h == nil {
 		return fmt.Errorf("mtp: cannot run operation %v, device is not open",
 			OC_names[int(req.Code)])
 	}
-	if err := d.runTransaction(req, rep, dest, src, writeSize); err != nil {
+	if err := d.txIO().runTransaction(ctx, req, rep, dest, src, writeSize); err != nil {
 		_, ok2 := err.(SyncError)
 		_, ok1 := err.(usb.Error)
-		if ok1 || ok2 {
+		if ok1 || ok2 || ctx.Err() != nil {
 			log.MTP.Errorf("fatal error %v; closing connection.", err)
 			d.Close()
 		}
@@ -302,104 +278,6 @@ func (d *DeviceDirect) RunTransaction(req *Container, rep *Container,
 	return nil
 }
 
-// runTransaction is like RunTransaction, but without sanity checking
-// before and after the call.
-func (d *DeviceDirect) runTransaction(req *Container, rep *Container,
-	dest io.Writer, src io.Reader, writeSize int64) error {
-	var finalPacket []byte
-	if d.session != nil {
-		req.SessionID = d.session.sid
-		req.TransactionID = d.session.tid
-		d.session.tid++
-	}
-
-	if d.Debug.MTP {
-		log.MTP.Debugf("request %s %v\n", OC_names[int(req.Code)], req.Param)
-	}
-
-	if err := d.sendReq(req); err != nil {
-		if d.Debug.MTP {
-			log.MTP.Debugf("sendreq failed: %v\n", err)
-		}
-		return err
-	}
-
-	if src != nil {
-		hdr := usbBulkHeader{
-			Type:          USB_CONTAINER_DATA,
-			Code:          req.Code,
-			Length:        uint32(writeSize),
-			TransactionID: req.TransactionID,
-		}
-
-		_, err := d.bulkWrite(&hdr, src, writeSize)
-		if err != nil {
-			return err
-		}
-	}
-	fetchPacketSize := d.fetchMaxPacketSize()
-	data := make([]byte, fetchPacketSize)
-	h := &usbBulkHeader{}
-	rest, err := d.fetchPacket(data[:], h)
-	if err != nil {
-		return err
-	}
-	var unexpectedData bool
-	if h.Type == USB_CONTAINER_DATA {
-		if dest == nil {
-			dest = &NullWriter{}
-			unexpectedData = true
-			if d.Debug.MTP {
-				log.MTP.Debugf("discarding unexpected data 0x%x bytes", h.Length)
-			}
-		}
-		if d.Debug.MTP {
-			log.MTP.Debugf("data 0x%x bytes", h.Length)
-		}
-
-		dest.Write(rest)
-
-		if len(rest)+usbHdrLen == fetchPacketSize {
-			// If this was a full packet, read until we
-			// have a short read.
-			_, finalPacket, err = d.bulkRead(dest)
-			if err != nil {
-				return err
-			}
-		}
-
-		h = &usbBulkHeader{}
-		if len(finalPacket) > 0 {
-			if d.Debug.MTP {
-				log.MTP.Errorf("reusing final packet")
-			}
-			rest = finalPacket
-			finalBuf := bytes.NewBuffer(finalPacket[:len(finalPacket)])
-			err = binary.Read(finalBuf, binary.LittleEndian, h)
-		} else {
-			rest, err = d.fetchPacket(data[:], h)
-		}
-	}
-
-	err = d.decodeRep(h, rest, rep)
-	if d.Debug.MTP {
-		log.MTP.Debugf("response %s %v", getName(RC_names, int(rep.Code)), rep.Param)
-	}
-	if unexpectedData {
-		return SyncError(fmt.Sprintf("unexpected data for code %s", getName(RC_names, int(req.Code))))
-	}
-
-	if err != nil {
-		return err
-	}
-	if d.session != nil && rep.TransactionID != req.TransactionID {
-		return SyncError(fmt.Sprintf("transaction ID mismatch got %x want %x",
-			rep.TransactionID, req.TransactionID))
-	}
-	rep.SessionID = req.SessionID
-	return nil
-}
-
 // Prints data going over the USB connection.
 func (d *DeviceDirect) dataPrint(ep byte, data []byte) {
 	if !d.Debug.Data {
@@ -413,116 +291,16 @@ func (d *DeviceDirect) dataPrint(ep byte, data []byte) {
 	hexDump(data)
 }
 
-// bulkWrite returns the number of non-header bytes written.
-func (d *DeviceDirect) bulkWrite(hdr *usbBulkHeader, r io.Reader, size int64) (n int64, err error) {
-	packetSize := d.sendMaxPacketSize()
-	if hdr != nil {
-		if size+usbHdrLen > 0xFFFFFFFF {
-			hdr.Length = 0xFFFFFFFF
-		} else {
-			hdr.Length = uint32(size + usbHdrLen)
-		}
-
-		packetArr := make([]byte, packetSize)
-		var packet []byte
-		if d.SeparateHeader {
-			packet = packetArr[:usbHdrLen]
-		} else {
-			packet = packetArr[:]
-		}
-
-		buf := bytes.NewBuffer(packet[:0])
-		binary.Write(buf, byteOrder, hdr)
-		cpSize := int64(len(packet) - usbHdrLen)
-		if cpSize > size {
-			cpSize = size
-		}
-
-		_, err = io.CopyN(buf, r, cpSize)
-		d.dataPrint(d.sendEP, buf.Bytes())
-		_, err = d.h.BulkTransfer(d.sendEP, buf.Bytes(), d.Timeout)
-		if err != nil {
-			return cpSize, err
-		}
-		size -= cpSize
-		n += cpSize
-	}
-
-	var buf [rwBufSize]byte
-	var lastTransfer int
-	for size > 0 {
-		var m int
-		toread := buf[:]
-		if int64(len(toread)) > size {
-			toread = buf[:int(size)]
-		}
-
-		m, err = r.Read(toread)
-		if err != nil {
-			break
-		}
-		size -= int64(m)
-
-		d.dataPrint(d.sendEP, buf[:m])
-		lastTransfer, err = d.h.BulkTransfer(d.sendEP, buf[:m], d.Timeout)
-		n += int64(lastTransfer)
-
-		if err != nil || lastTransfer == 0 {
-			break
-		}
-	}
-	if lastTransfer%packetSize == 0 {
-		// write a short packet just to be sure.
-		d.h.BulkTransfer(d.sendEP, buf[:0], d.Timeout)
-	}
-
-	return n, err
-}
-
-func (d *DeviceDirect) bulkRead(w io.Writer) (n int64, lastPacket []byte, err error) {
-	var buf [rwBufSize]byte
-	var lastRead int
-	for {
-		toread := buf[:]
-		lastRead, err = d.h.BulkTransfer(d.fetchEP, toread, d.Timeout)
-		if err != nil {
-			break
-		}
-		if lastRead > 0 {
-			d.dataPrint(d.fetchEP, buf[:lastRead])
-
-			w, err := w.Write(buf[:lastRead])
-			n += int64(w)
-			if err != nil {
-				break
-			}
-		}
-		if d.Debug.MTP {
-			log.MTP.Debugf("bulk read 0x%x bytes.", lastRead)
-		}
-		if lastRead < len(toread) {
-			// short read.
-			break
-		}
-	}
-	packetSize := d.fetchMaxPacketSize()
-	if lastRead%packetSize == 0 {
-		// This should be a null packet, but on Linux + XHCI it's actually
-		// CONTAINER_OK instead. To be liberal with the XHCI behavior, return
-		// the final packet and inspect it in the calling function.
-		var nullReadSize int
-		nullReadSize, err = d.h.BulkTransfer(d.fetchEP, buf[:], d.Timeout)
-		if d.Debug.MTP {
-			log.MTP.Debugf("expected null packet, read %d bytes", nullReadSize)
-		}
-		return n, buf[:nullReadSize], err
-	}
-	return n, buf[:0], err
-}
-
 // Configure is a robust version of OpenSession. On failure, it resets
 // the device and reopens the device and the session.
 func (d *DeviceDirect) Configure() error {
+	return d.ConfigureContext(context.Background())
+}
+
+// ConfigureContext is like Configure, but ctx is honored while waiting
+// out the post-reset backoff, so a cancelled ctx (e.g. on Ctrl+C) aborts
+// configuration promptly instead of always waiting the full second.
+func (d *DeviceDirect) ConfigureContext(ctx context.Context) error {
 	if d.h == nil {
 		if err := d.Open(); err != nil {
 			return err
@@ -540,12 +318,16 @@ func (d *DeviceDirect) Configure() error {
 	if err != nil {
 		log.MTP.Warningf("failed to open session: %v, attempting reset", err)
 		if d.h != nil {
-			d.h.Reset()
+			d.transport.Reset()
 		}
 		d.Close()
 
-		// Give the device some rest.
-		time.Sleep(1000 * time.Millisecond)
+		// Give the device some rest, unless ctx is cancelled first.
+		select {
+		case <-time.After(1000 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 		if err := d.Open(); err != nil {
 			return fmt.Errorf("opening after reset: %v", err)
 		}
@@ -0,0 +1,303 @@
+package mtp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/gousb"
+)
+
+// DeviceGoUSB implements mtp.Device.
+// It accesses libusb via gousb instead of the unmaintained hanwen/usb
+// bindings used by DeviceDirect. Prefer this backend on platforms where
+// hanwen/usb's libusb bindings misbehave.
+type DeviceGoUSB struct {
+	dev         *gousb.Device
+	devDesc     *gousb.DeviceDesc
+	configDesc  gousb.ConfigDesc
+	ifaceDesc   gousb.InterfaceDesc
+	sendEPDesc  gousb.EndpointDesc
+	fetchEPDesc gousb.EndpointDesc
+	eventEPDesc gousb.EndpointDesc
+
+	iConfiguration int
+	iInterface     int
+	iAltSetting    int
+
+	sendEP  *gousb.OutEndpoint
+	fetchEP *gousb.InEndpoint
+	eventEP *gousb.InEndpoint
+
+	// In milliseconds. Defaults to 2 seconds.
+	Timeout int
+
+	Debug DebugFlags
+
+	session *sessionData
+
+	// transport carries sendReq/fetchPacket/bulkRead/bulkWrite's actual
+	// USB traffic. It's set up in Open once sendEP/fetchEP/eventEP are
+	// known. The field is unexported, so only code inside package mtp can
+	// replace it; mtp/mtptest imports mtp, so its FakeTransport cannot be
+	// used from package mtp's own tests.
+	transport Transport
+}
+
+func (d *DeviceGoUSB) connected() bool {
+	return d.sendEP != nil
+}
+
+// Close closes the MTP session if one is open, and releases the
+// interface and its configuration. The underlying gousb.Device is left
+// open, so Open can be called on d again.
+func (d *DeviceGoUSB) Close() error {
+	if !d.connected() {
+		return nil // or error?
+	}
+
+	if d.session != nil {
+		var req, rep Container
+		req.Code = OC_CloseSession
+		// RunTransaction runs close, so can't use CloseSession().
+
+		if err := d.txIO().runTransaction(context.Background(), &req, &rep, nil, nil, 0); err != nil {
+			if d.Debug.USB {
+				log.USB.Debugf("close session failed, err: %v", err)
+			}
+		}
+		d.session = nil
+	}
+
+	err := d.transport.Close()
+	if d.Debug.USB {
+		log.USB.Debugf("closeConfig, err: %v", err)
+	}
+
+	d.sendEP = nil
+	d.fetchEP = nil
+	d.eventEP = nil
+	return err
+}
+
+// Open opens an MTP device.
+func (d *DeviceGoUSB) Open() error {
+	if d.Timeout == 0 {
+		d.Timeout = 2000
+	}
+
+	if d.connected() {
+		return fmt.Errorf("already open")
+	}
+
+	cfg, err := d.dev.Config(d.iConfiguration)
+	if err != nil {
+		return fmt.Errorf("failed to open configuration: %w", err)
+	}
+
+	iface, err := cfg.Interface(d.iInterface, d.iAltSetting)
+	if err != nil {
+		cfg.Close()
+		return fmt.Errorf("failed to open interface: %w", err)
+	}
+
+	d.sendEP, err = iface.OutEndpoint(int(d.sendEPDesc.Number))
+	if err != nil {
+		cfg.Close()
+		iface.Close()
+		return fmt.Errorf("failed to open send EP: %w", err)
+	}
+
+	d.fetchEP, err = iface.InEndpoint(int(d.fetchEPDesc.Number))
+	if err != nil {
+		cfg.Close()
+		iface.Close()
+		return fmt.Errorf("failed to open fetch EP: %w", err)
+	}
+
+	d.eventEP, err = iface.InEndpoint(int(d.eventEPDesc.Number))
+	if err != nil {
+		cfg.Close()
+		iface.Close()
+		return fmt.Errorf("failed to open event EP: %w", err)
+	}
+
+	d.transport = &GousbTransport{
+		dev:     d.dev,
+		cfg:     cfg,
+		iface:   iface,
+		sendEP:  d.sendEP,
+		fetchEP: d.fetchEP,
+		eventEP: d.eventEP,
+	}
+
+	if len(d.ifaceDesc.AltSettings) == 0 {
+		// Some of the win8phones have no interface field.
+		info := DeviceInfo{}
+		d.GetDeviceInfo(&info)
+
+		if !strings.Contains(info.MTPExtension, "icrosoft") {
+			d.Close()
+			return fmt.Errorf("mtp: no MTP extensions in '%s'", info.MTPExtension)
+		}
+	} else if iface.Setting.Class != gousb.ClassPTP {
+		d.Close()
+		return fmt.Errorf("has no MTP in interface class")
+	}
+
+	return nil
+}
+
+// ID is the manufacturer + product + serial
+func (d *DeviceGoUSB) ID() (ID, error) {
+	if !d.connected() {
+		return ID{}, fmt.Errorf("mtp: ID: device not open")
+	}
+
+	m, err := d.dev.Manufacturer()
+	if err != nil {
+		return ID{}, err
+	}
+
+	p, err := d.dev.Product()
+	if err != nil {
+		return ID{}, err
+	}
+
+	s, err := d.dev.SerialNumber()
+	if err != nil {
+		return ID{}, err
+	}
+
+	return ID{Manufacturer: m, Product: p, SerialNumber: s}, nil
+}
+
+// txIO builds the shared transaction state machine's view of this
+// device. Called fresh per transaction since d.session changes across
+// OpenSession/CloseSession calls.
+func (d *DeviceGoUSB) txIO() *transactionIO {
+	return &transactionIO{
+		transport: d.transport,
+		session:   d.session,
+		debug:     d.Debug,
+		logSend:   func(data []byte) { d.dataPrint(d.sendEPDesc, data) },
+		logFetch:  func(data []byte) { d.dataPrint(d.fetchEPDesc, data) },
+	}
+}
+
+func (d *DeviceGoUSB) RunTransactionWithNoParams(code uint16) error {
+	var req, rep Container
+	req.Code = code
+	req.Param = []uint32{}
+	return d.RunTransaction(&req, &rep, nil, nil, 0)
+}
+
+// Runs a single MTP transaction. dest and src cannot be specified at
+// the same time.  The request should fill out Code and Param as
+// necessary. The response is provided here, but usually only the
+// return code is of interest.  If the return code is an error, this
+// function will return an RCError instance.
+//
+// Errors that are likely to affect future transactions lead to
+// closing the connection. Such errors include: invalid transaction
+// IDs, USB errors (BUSY, IO, ACCESS etc.), and receiving data for
+// operations that expect no data.
+func (d *DeviceGoUSB) RunTransaction(req *Container, rep *Container,
+	dest io.Writer, src io.Reader, writeSize int64) error {
+	ctx := context.Background()
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(d.Timeout)*time.Millisecond)
+		defer cancel()
+	}
+	return d.RunTransactionContext(ctx, req, rep, dest, src, writeSize)
+}
+
+// RunTransactionContext is like RunTransaction, but ctx governs
+// cancellation instead of d.Timeout. The transaction runs synchronously
+// on the calling goroutine: d.transport's BulkOut/BulkIn are handed ctx
+// directly, so gousb's native libusb_cancel_transfer support aborts the
+// in-flight transfer the instant ctx is done. There is no separate
+// goroutine racing d.Close() against an in-flight transfer on this
+// device's own state.
+func (d *DeviceGoUSB) RunTransactionContext(ctx context.Context, req *Container, rep *Container,
+	dest io.Writer, src io.Reader, writeSize int64) error {
+	if !d.connected() {
+		return fmt.Errorf("mtp: cannot run operation %v, device is not open",
+			OC_names[int(req.Code)])
+	}
+	if err := d.txIO().runTransaction(ctx, req, rep, dest, src, writeSize); err != nil {
+		_, ok2 := err.(SyncError)
+		_, ok1 := err.(gousb.Error)
+		_, ok3 := err.(gousb.TransferStatus)
+		if ok1 || ok2 || ok3 || ctx.Err() != nil {
+			log.MTP.Errorf("fatal error %v; closing connection.", err)
+			d.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+// Prints data going over the USB connection.
+func (d *DeviceGoUSB) dataPrint(epDesc gousb.EndpointDesc, data []byte) {
+	if !d.Debug.Data {
+		return
+	}
+	dir := "send"
+	if epDesc.Direction == gousb.EndpointDirectionIn {
+		dir = "recv"
+	}
+	fmt.Fprintf(os.Stderr, "%s: 0x%x bytes with ep 0x%x:\n", dir, len(data), byte(epDesc.Address))
+	hexDump(data)
+}
+
+// Configure is a robust version of OpenSession. On failure, it resets
+// the device and reopens the device and the session.
+func (d *DeviceGoUSB) Configure() error {
+	return d.ConfigureContext(context.Background())
+}
+
+// ConfigureContext is like Configure, but ctx is honored while waiting
+// out the post-reset backoff, so a cancelled ctx (e.g. on Ctrl+C) aborts
+// configuration promptly instead of always waiting the full second.
+func (d *DeviceGoUSB) ConfigureContext(ctx context.Context) error {
+	if !d.connected() {
+		if err := d.Open(); err != nil {
+			return err
+		}
+	}
+
+	err := d.OpenSession()
+	if err == RCError(RC_SessionAlreadyOpened) {
+		// It's open, so close the session. Fortunately, this
+		// even works without a transaction ID, at least on Android.
+		d.CloseSession()
+		err = d.OpenSession()
+	}
+
+	if err != nil {
+		log.MTP.Warningf("failed to open session: %v, attempting reset", err)
+		if d.connected() {
+			d.transport.Reset()
+		}
+		d.Close()
+
+		// Give the device some rest, unless ctx is cancelled first.
+		select {
+		case <-time.After(1000 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err := d.Open(); err != nil {
+			return fmt.Errorf("opening after reset: %v", err)
+		}
+		if err := d.OpenSession(); err != nil {
+			return fmt.Errorf("openSession after reset: %v", err)
+		}
+	}
+	return nil
+}
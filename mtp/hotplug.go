@@ -0,0 +1,158 @@
+package mtp
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// HotplugEventType distinguishes the kinds of events HotplugMonitor emits.
+type HotplugEventType int
+
+const (
+	Attached HotplugEventType = iota
+	Detached
+)
+
+func (t HotplugEventType) String() string {
+	if t == Attached {
+		return "attached"
+	}
+	return "detached"
+}
+
+// HotplugEvent reports a device matching a HotplugMonitor's VID/PID
+// filter appearing on or disappearing from the USB bus.
+type HotplugEvent struct {
+	Type            HotplugEventType
+	Vendor, Product uint16
+	Bus, Address    uint8
+}
+
+// hotplugKey identifies a physical USB port occupant across polls. Bus
+// and device address are reassigned by the host on every (re)attach, so
+// they're stable enough to distinguish "still there" from "gone and a
+// different device showed up", which is all a poll needs to know.
+type hotplugKey struct {
+	bus, address uint8
+}
+
+// HotplugMonitor is a partial, polling-only stand-in for real USB
+// hotplug detection: it watches for MTP-looking devices matching a
+// VID/PID filter (0 matches any) attaching or detaching by polling the
+// bus every Interval and diffing against the previous poll, then emits
+// Attached/Detached events on a channel. There is no
+// libusb_hotplug_register_callback underneath this, so events lag
+// attach/detach by up to Interval rather than firing immediately.
+//
+// Neither gousb nor hanwen/usb, the two backends this package vendors,
+// expose libusb_hotplug_register_callback, and wiring it up would need
+// a new cgo shim calling into libusb directly; that hasn't been done,
+// so polling (using the same descriptor-only enumeration
+// FindDevicesDirect uses, with no device opened) is what this monitor
+// actually does today, not a deliberate design choice over a real
+// callback.
+//
+// Each poll opens and releases its own libusb context via
+// FindDevicesDirect, so a Monitor left running for the process lifetime
+// (the case Run's doc comment below describes) doesn't accumulate
+// libusb contexts tick over tick.
+type HotplugMonitor struct {
+	VendorID, ProductID uint16
+	Interval            time.Duration
+
+	events chan HotplugEvent
+	done   chan struct{}
+}
+
+// NewHotplugMonitor creates a monitor for the given VID/PID (0 matches
+// any vendor/product respectively). Call Run to start polling.
+func NewHotplugMonitor(vid, pid uint16, interval time.Duration) *HotplugMonitor {
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	return &HotplugMonitor{
+		VendorID:  vid,
+		ProductID: pid,
+		Interval:  interval,
+		events:    make(chan HotplugEvent, 16),
+		done:      make(chan struct{}),
+	}
+}
+
+// Events returns the channel Attached/Detached events are published on.
+// It is closed once Run returns.
+func (m *HotplugMonitor) Events() <-chan HotplugEvent {
+	return m.events
+}
+
+// Run polls the bus until ctx is cancelled or Close is called, and
+// should be run in its own goroutine alongside the live-view loop: on a
+// Detached event for the currently open camera, the caller should tear
+// the live-view loop down cleanly, and on the next matching Attached
+// event call Configure() again to resume streaming without user
+// intervention.
+func (m *HotplugMonitor) Run(ctx context.Context) error {
+	defer close(m.events)
+
+	present := map[hotplugKey]HotplugEvent{}
+	poll := func() error {
+		devs, err := FindDevicesDirect(m.VendorID, m.ProductID)
+		if err != nil {
+			return err
+		}
+
+		seen := map[hotplugKey]bool{}
+		for _, d := range devs {
+			key := hotplugKey{d.dev.GetBusNumber(), d.dev.GetDeviceAddress()}
+			seen[key] = true
+			if _, ok := present[key]; !ok {
+				ev := HotplugEvent{
+					Type:    Attached,
+					Vendor:  d.devDescr.IdVendor,
+					Product: d.devDescr.IdProduct,
+					Bus:     key.bus,
+					Address: key.address,
+				}
+				present[key] = ev
+				m.events <- ev
+			}
+			d.Done() // we only needed identity, not a claimed handle.
+		}
+
+		for key, ev := range present {
+			if !seen[key] {
+				ev.Type = Detached
+				m.events <- ev
+				delete(present, key)
+			}
+		}
+		return nil
+	}
+
+	if err := poll(); err != nil {
+		return fmt.Errorf("hotplug: initial poll failed: %w", err)
+	}
+
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-m.done:
+			return nil
+		case <-ticker.C:
+			if err := poll(); err != nil {
+				log.USB.Warningf("hotplug: poll failed: %v", err)
+			}
+		}
+	}
+}
+
+// Close stops Run.
+func (m *HotplugMonitor) Close() error {
+	close(m.done)
+	return nil
+}
@@ -0,0 +1,131 @@
+// Package mtptest provides a fake mtp.Transport for exercising the MTP
+// transaction state machine without a real USB stack.
+package mtptest
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/puhitaku/mtplvcap/mtp"
+)
+
+// Step is one recorded USB transfer. A FakeTransport replays Steps in
+// order: each call to BulkOut/BulkIn/InterruptIn consumes the next Step
+// and fails if its Op doesn't match.
+type Step struct {
+	Op Op
+	// Want, for an Out step, is the payload the call is expected to
+	// write; a mismatch fails the step. Data, for an In step, is the
+	// payload copied into the caller's buffer.
+	Want []byte
+	Data []byte
+	Err  error
+}
+
+// Op identifies which Transport method a Step replays.
+type Op int
+
+const (
+	OpBulkOut Op = iota
+	OpBulkIn
+	OpInterruptIn
+)
+
+// FakeTransport implements mtp.Transport by replaying a fixed sequence
+// of Steps recorded ahead of time, e.g. from a USB capture of a real
+// transaction. Tests drive it through its mtp.Transport methods, as
+// faketransport_test.go does; DeviceDirect's and DeviceGoUSB's transport
+// fields are unexported, so it cannot be installed in either from
+// outside package mtp.
+type FakeTransport struct {
+	steps []Step
+	pos   int
+
+	sendMaxPacketSize  int
+	fetchMaxPacketSize int
+
+	resets int
+	closed bool
+}
+
+// NewFakeTransport returns a FakeTransport that replays steps in order.
+// maxPacketSize is reported by MaxPacketSize for both directions.
+func NewFakeTransport(maxPacketSize int, steps ...Step) *FakeTransport {
+	return &FakeTransport{
+		steps:              steps,
+		sendMaxPacketSize:  maxPacketSize,
+		fetchMaxPacketSize: maxPacketSize,
+	}
+}
+
+func (t *FakeTransport) next(op Op) (Step, error) {
+	if t.pos >= len(t.steps) {
+		return Step{}, fmt.Errorf("mtptest: no more steps, got op %v", op)
+	}
+	s := t.steps[t.pos]
+	t.pos++
+	if s.Op != op {
+		return Step{}, fmt.Errorf("mtptest: step %d: got op %v, want %v", t.pos-1, op, s.Op)
+	}
+	return s, nil
+}
+
+func (t *FakeTransport) BulkOut(ctx context.Context, p []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s, err := t.next(OpBulkOut)
+	if err != nil {
+		return 0, err
+	}
+	if s.Want != nil && string(s.Want) != string(p) {
+		return 0, fmt.Errorf("mtptest: step %d: got %x, want %x", t.pos-1, p, s.Want)
+	}
+	return len(p), s.Err
+}
+
+func (t *FakeTransport) BulkIn(ctx context.Context, p []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s, err := t.next(OpBulkIn)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, s.Data)
+	return n, s.Err
+}
+
+func (t *FakeTransport) InterruptIn(ctx context.Context, p []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s, err := t.next(OpInterruptIn)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, s.Data)
+	return n, s.Err
+}
+
+func (t *FakeTransport) MaxPacketSize(dir mtp.EndpointDirection) int {
+	if dir == mtp.DirectionOut {
+		return t.sendMaxPacketSize
+	}
+	return t.fetchMaxPacketSize
+}
+
+func (t *FakeTransport) Reset() error {
+	t.resets++
+	return nil
+}
+
+func (t *FakeTransport) Close() error {
+	t.closed = true
+	return nil
+}
+
+// Done reports whether every recorded Step has been consumed.
+func (t *FakeTransport) Done() bool {
+	return t.pos == len(t.steps)
+}
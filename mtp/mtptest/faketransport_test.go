@@ -0,0 +1,57 @@
+package mtptest
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFakeTransportReplay(t *testing.T) {
+	ft := NewFakeTransport(64,
+		Step{Op: OpBulkOut, Want: []byte("cmd")},
+		Step{Op: OpBulkIn, Data: []byte("reply")},
+	)
+
+	n, err := ft.BulkOut(context.Background(), []byte("cmd"))
+	if err != nil || n != 3 {
+		t.Fatalf("BulkOut = %d, %v, want 3, nil", n, err)
+	}
+
+	buf := make([]byte, 64)
+	n, err = ft.BulkIn(context.Background(), buf)
+	if err != nil || string(buf[:n]) != "reply" {
+		t.Fatalf("BulkIn = %q, %v, want %q, nil", buf[:n], err, "reply")
+	}
+
+	if !ft.Done() {
+		t.Errorf("Done() = false, want true after consuming all steps")
+	}
+}
+
+func TestFakeTransportWantMismatch(t *testing.T) {
+	ft := NewFakeTransport(64, Step{Op: OpBulkOut, Want: []byte("expected")})
+
+	if _, err := ft.BulkOut(context.Background(), []byte("actual")); err == nil {
+		t.Error("BulkOut with mismatched Want: got nil error, want an error")
+	}
+}
+
+func TestFakeTransportWrongOp(t *testing.T) {
+	ft := NewFakeTransport(64, Step{Op: OpBulkIn, Data: []byte("x")})
+
+	if _, err := ft.BulkOut(context.Background(), []byte("x")); err == nil {
+		t.Error("BulkOut against a step recorded as OpBulkIn: got nil error, want an error")
+	}
+}
+
+func TestFakeTransportResetAndClose(t *testing.T) {
+	ft := NewFakeTransport(64)
+	if err := ft.Reset(); err != nil {
+		t.Errorf("Reset: %v", err)
+	}
+	if err := ft.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if ft.resets != 1 || !ft.closed {
+		t.Errorf("resets=%d closed=%v, want 1, true", ft.resets, ft.closed)
+	}
+}
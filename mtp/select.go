@@ -0,0 +1,286 @@
+package mtp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/gousb"
+	"github.com/hanwen/usb"
+)
+
+// Device is the surface DeviceDirect and DeviceGoUSB both implement, so
+// callers that don't care which backend they got can use SelectDevice
+// instead of hardcoding SelectDeviceDirect or SelectDeviceGoUSB.
+type Device interface {
+	Close() error
+	ID() (ID, error)
+
+	Configure() error
+	ConfigureContext(ctx context.Context) error
+
+	RunTransactionWithNoParams(code uint16) error
+	RunTransaction(req, rep *Container, dest io.Writer, src io.Reader, writeSize int64) error
+	RunTransactionContext(ctx context.Context, req, rep *Container, dest io.Writer, src io.Reader, writeSize int64) error
+}
+
+// Backend picks which USB stack SelectDevice opens a device through.
+type Backend int
+
+const (
+	// BackendDirect uses hanwen/usb. It's the long-standing default.
+	BackendDirect Backend = iota
+	// BackendGoUSB uses gousb, for platforms where hanwen/usb's libusb
+	// bindings misbehave.
+	BackendGoUSB
+)
+
+// SelectDevice opens an MTP device on the requested backend, matching
+// vid/pid as SelectDeviceDirect/SelectDeviceGoUSB do. goUSBCtx is only
+// used (and required) for BackendGoUSB; callers that only ever use
+// BackendDirect can pass nil.
+//
+// This only selects *which backend's code path runs*; there is no flag
+// parsing here; a cmd/ package wiring a "-backend" flag (or similar) to
+// this would be the natural way to expose backend choice to users, but
+// no such command exists in this tree yet.
+//
+// TODO: this is the open half of the original request, which asked for
+// a build tag or runtime flag users can pick a backend with at
+// startup. Revisit once this repo has a cmd/ package to wire one into.
+func SelectDevice(backend Backend, goUSBCtx *gousb.Context, vid, pid uint16) (Device, error) {
+	switch backend {
+	case BackendGoUSB:
+		if goUSBCtx == nil {
+			return nil, fmt.Errorf("mtp: BackendGoUSB requires a non-nil gousb.Context")
+		}
+		return SelectDeviceGoUSB(goUSBCtx, vid, pid)
+	default:
+		return SelectDeviceDirect(vid, pid)
+	}
+}
+
+// candidateFromDeviceDescriptor inspects a hanwen/usb device's
+// configuration for an interface that looks like MTP/PTP (exactly one
+// interrupt-IN, one bulk-IN and one bulk-OUT endpoint), returning a
+// half-populated DeviceDirect if one is found.
+func candidateFromDeviceDescriptor(d *usb.Device) *DeviceDirect {
+	dd, err := d.GetDeviceDescriptor()
+	if err != nil {
+		return nil
+	}
+	for i := byte(0); i < dd.NumConfigurations; i++ {
+		cdesc, err := d.GetConfigDescriptor(i)
+		if err != nil {
+			return nil
+		}
+		for _, iface := range cdesc.Interfaces {
+			for _, a := range iface.AltSetting {
+				if len(a.EndPoints) != 3 {
+					continue
+				}
+				m := DeviceDirect{}
+				for _, s := range a.EndPoints {
+					switch {
+					case s.Direction() == usb.ENDPOINT_IN && s.TransferType() == usb.TRANSFER_TYPE_INTERRUPT:
+						m.eventEP = s.EndpointAddress
+					case s.Direction() == usb.ENDPOINT_IN && s.TransferType() == usb.TRANSFER_TYPE_BULK:
+						m.fetchEP = s.EndpointAddress
+					case s.Direction() == usb.ENDPOINT_OUT && s.TransferType() == usb.TRANSFER_TYPE_BULK:
+						m.sendEP = s.EndpointAddress
+					}
+				}
+				if m.sendEP > 0 && m.fetchEP > 0 && m.eventEP > 0 {
+					m.devDescr = *dd
+					m.ifaceDescr = a
+					m.dev = d.Ref()
+					m.configValue = cdesc.ConfigurationValue
+					return &m
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// FindDevicesDirect enumerates MTP-looking devices on the hanwen/usb
+// (libusb) backend, optionally filtered to a single VID/PID pair.
+func FindDevicesDirect(vid, pid uint16) ([]*DeviceDirect, error) {
+	c := usb.NewContext()
+	defer c.Exit()
+
+	l, err := c.GetDeviceList()
+	if err != nil {
+		return nil, err
+	}
+	if len(l) > 0 {
+		defer l.Done()
+	}
+
+	var devs []*DeviceDirect
+	for _, d := range l {
+		v, _ := d.GetDeviceDescriptor()
+		if vid != 0 && v.IdVendor != vid {
+			continue
+		} else if pid != 0 && v.IdProduct != pid {
+			continue
+		}
+		if cand := candidateFromDeviceDescriptor(d); cand != nil {
+			log.USB.Infof("found: %04x:%04x", v.IdVendor, v.IdProduct)
+			devs = append(devs, cand)
+		}
+	}
+	return devs, nil
+}
+
+// SelectDeviceDirect returns an opened MTP device using the hanwen/usb
+// backend that matches the given VID/PID, or the first MTP device found
+// if either is zero. This is the default backend; use SelectDeviceGoUSB
+// (e.g. behind a "-backend-go" style flag) where hanwen/usb's libusb
+// bindings misbehave.
+func SelectDeviceDirect(vid, pid uint16) (*DeviceDirect, error) {
+	devs, err := FindDevicesDirect(vid, pid)
+	if err != nil {
+		return nil, err
+	}
+	if len(devs) == 0 {
+		return nil, fmt.Errorf("no MTP devices found")
+	}
+
+	dev := devs[0]
+	vendor, product := dev.devDescr.IdVendor, dev.devDescr.IdProduct
+	if len(devs) > 1 {
+		log.MTP.Warningf("detected more than 1 device, opening the first: %04x:%04x", vendor, product)
+	}
+
+	if err := dev.Open(); err != nil {
+		return nil, fmt.Errorf("could not open %04x:%04x: %s", vendor, product, err)
+	}
+
+	config, err := dev.h.GetConfiguration()
+	if err != nil {
+		return nil, fmt.Errorf("could not get configuration of %04x:%04x: %v", vendor, product, err)
+	}
+	if config != dev.configValue {
+		if err := dev.h.SetConfiguration(dev.configValue); err != nil {
+			return nil, fmt.Errorf("could not set configuration of %04x:%04x: %v", vendor, product, err)
+		}
+	}
+
+	return dev, nil
+}
+
+// FindDevicesGoUSB enumerates MTP-looking devices on the gousb backend,
+// optionally filtered to a single VID/PID pair. The returned devices
+// hold open gousb.Device handles, but their MTP interface is not claimed
+// until Open is called on them (SelectDeviceGoUSB does this for the
+// device it returns).
+func FindDevicesGoUSB(ctx *gousb.Context, vid, pid uint16) ([]*DeviceGoUSB, error) {
+	// byDesc is keyed by the *gousb.DeviceDesc pointer the opener below
+	// is called with, which is the same pointer OpenDevices' returned
+	// *gousb.Device.Desc carries. That's what lets us correlate the two
+	// without relying on their slices lining up index-for-index: if
+	// opening a matching device fails (permissions, unplugged between
+	// enumeration and open), OpenDevices omits it from devs (and reports
+	// the failure in its error), which would otherwise desync any
+	// index-based pairing.
+	byDesc := make(map[*gousb.DeviceDesc]*DeviceGoUSB)
+
+	devs, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
+		v, p := uint16(desc.Vendor), uint16(desc.Product)
+		if vid != 0 && v != vid {
+			return false
+		}
+		if pid != 0 && p != pid {
+			return false
+		}
+
+		for _, conf := range desc.Configs {
+			for _, iface := range conf.Interfaces {
+				for _, alt := range iface.AltSettings {
+					if len(alt.Endpoints) != 3 {
+						continue
+					}
+
+					var ev, fe, se gousb.EndpointDesc
+					for _, ep := range alt.Endpoints {
+						switch {
+						case ep.Direction == gousb.EndpointDirectionIn && ep.TransferType == gousb.TransferTypeInterrupt:
+							ev = ep
+						case ep.Direction == gousb.EndpointDirectionIn && ep.TransferType == gousb.TransferTypeBulk:
+							fe = ep
+						case ep.Direction == gousb.EndpointDirectionOut && ep.TransferType == gousb.TransferTypeBulk:
+							se = ep
+						}
+					}
+
+					if se.Address > 0 && fe.Address > 0 && ev.Address > 0 {
+						byDesc[desc] = &DeviceGoUSB{
+							devDesc:     desc,
+							ifaceDesc:   iface,
+							sendEPDesc:  se,
+							fetchEPDesc: fe,
+							eventEPDesc: ev,
+							configDesc:  conf,
+
+							iConfiguration: conf.Number,
+							iInterface:     iface.Number,
+							iAltSetting:    alt.Number,
+						}
+						log.USB.Infof("found: %04x:%04x", v, p)
+						return true
+					}
+				}
+			}
+		}
+		return false
+	})
+	if err != nil {
+		if len(devs) == 0 {
+			return nil, fmt.Errorf("failed to iterate USB devices: %s", err)
+		}
+		log.USB.Warningf("some USB devices could not be opened: %s", err)
+	}
+
+	// devs only contains devices OpenDevices actually managed to open,
+	// which can be a subset of byDesc if an open call failed after the
+	// opener returned true; look each one up by its own Desc rather
+	// than assuming devs and byDesc line up.
+	found := make([]*DeviceGoUSB, 0, len(devs))
+	for _, dev := range devs {
+		d, ok := byDesc[dev.Desc]
+		if !ok {
+			continue
+		}
+		d.dev = dev
+		found = append(found, d)
+	}
+	return found, nil
+}
+
+// SelectDeviceGoUSB returns an opened MTP device using the gousb backend
+// that matches the given VID/PID (either may be zero to match any). It
+// returns an error if no device or more than one device matches.
+func SelectDeviceGoUSB(ctx *gousb.Context, vid, pid uint16) (*DeviceGoUSB, error) {
+	devs, err := FindDevicesGoUSB(ctx, vid, pid)
+	if err != nil {
+		return nil, err
+	}
+	if len(devs) == 0 {
+		return nil, fmt.Errorf("found no MTP devices")
+	}
+	if len(devs) > 1 {
+		var s []string
+		for i, d := range devs {
+			s = append(s, fmt.Sprintf("%d. %04x:%04x", i+1, d.devDesc.Vendor, d.devDesc.Product))
+		}
+		return nil, fmt.Errorf("found multiple MTP devices: %s", strings.Join(s, ", "))
+	}
+
+	dev := devs[0]
+	if err := dev.Open(); err != nil {
+		return nil, fmt.Errorf("could not open %04x:%04x: %s", dev.devDesc.Vendor, dev.devDesc.Product, err)
+	}
+	return dev, nil
+}
@@ -0,0 +1,150 @@
+package mtp
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// transferPoolSize is the number of bulk transfers kept in flight at
+// once by StreamBulkRead/StreamBulkWrite on backends that support
+// pipelined submission. This amortizes the USB round-trip latency that
+// otherwise dominates high-framerate live-view fetches.
+const transferPoolSize = 6
+
+// BulkSink receives successive chunks read by StreamBulkRead. It must
+// not retain p past the call; copy it if the data is needed afterwards.
+type BulkSink func(p []byte) error
+
+// StreamBulkRead continuously reads from the fetch endpoint and hands
+// each chunk to sink until ctx is cancelled or sink/the transfer returns
+// an error. On gousb, a pool of transferPoolSize transfers is kept
+// pre-submitted so a completed URB is immediately resubmitted instead
+// of waiting for the caller to ask for more data; other backends fall
+// back to sequential synchronous reads.
+//
+// This is meant as the fast path for a live-view loop fetching frames
+// with something like OC_NIKON_GetLiveViewImg, but no such loop exists
+// in this tree yet (it would live in a mtp_lv.go or similar), so
+// StreamBulkRead/StreamBulkWrite currently have no caller.
+func (d *DeviceGoUSB) StreamBulkRead(ctx context.Context, sink BulkSink) error {
+	if !d.connected() {
+		return fmt.Errorf("mtp: StreamBulkRead: device is not open")
+	}
+
+	stream, err := d.fetchEP.NewStream(d.fetchEPDesc.MaxPacketSize, transferPoolSize)
+	if err != nil {
+		return fmt.Errorf("mtp: failed to start read stream: %w", err)
+	}
+	defer stream.Close()
+
+	buf := make([]byte, d.fetchEPDesc.MaxPacketSize)
+	for {
+		n, err := stream.ReadContext(ctx, buf)
+		if n > 0 {
+			if serr := sink(buf[:n]); serr != nil {
+				return serr
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// StreamBulkRead is the hanwen/usb fallback for StreamBulkRead: that
+// backend has no async submit, so it issues one synchronous
+// BulkTransfer at a time, checking ctx between reads. Callers still
+// benefit from the unified BulkSink-based API even though the
+// pipelining speedup only applies to the gousb backend.
+func (d *DeviceDirect) StreamBulkRead(ctx context.Context, sink BulkSink) error {
+	if d.h == nil {
+		return fmt.Errorf("mtp: StreamBulkRead: device is not open")
+	}
+
+	buf := make([]byte, d.fetchMaxPacketSize())
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := d.h.BulkTransfer(d.fetchEP, buf, d.Timeout)
+		if n > 0 {
+			if serr := sink(buf[:n]); serr != nil {
+				return serr
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// StreamBulkWrite is the send-path counterpart of StreamBulkRead: it
+// drains r onto the send endpoint using a pipelined write stream so
+// that a write is queued while the previous one is still in flight.
+func (d *DeviceGoUSB) StreamBulkWrite(ctx context.Context, r io.Reader) (int64, error) {
+	if !d.connected() {
+		return 0, fmt.Errorf("mtp: StreamBulkWrite: device is not open")
+	}
+
+	stream, err := d.sendEP.NewStream(d.sendEPDesc.MaxPacketSize, transferPoolSize)
+	if err != nil {
+		return 0, fmt.Errorf("mtp: failed to start write stream: %w", err)
+	}
+	defer stream.CloseContext(ctx)
+
+	var n int64
+	buf := make([]byte, d.sendEPDesc.MaxPacketSize)
+	for {
+		m, rerr := r.Read(buf)
+		if m > 0 {
+			w, werr := stream.WriteContext(ctx, buf[:m])
+			n += int64(w)
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if rerr != nil {
+			if rerr == io.EOF {
+				return n, nil
+			}
+			return n, rerr
+		}
+	}
+}
+
+// StreamBulkWrite is the hanwen/usb fallback: it writes synchronously,
+// one BulkTransfer at a time.
+func (d *DeviceDirect) StreamBulkWrite(ctx context.Context, r io.Reader) (int64, error) {
+	if d.h == nil {
+		return 0, fmt.Errorf("mtp: StreamBulkWrite: device is not open")
+	}
+
+	var n int64
+	buf := make([]byte, d.sendMaxPacketSize())
+	for {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		m, rerr := r.Read(buf)
+		if m > 0 {
+			w, werr := d.h.BulkTransfer(d.sendEP, buf[:m], d.Timeout)
+			n += int64(w)
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if rerr != nil {
+			if rerr == io.EOF {
+				return n, nil
+			}
+			return n, rerr
+		}
+	}
+}
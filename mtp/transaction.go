@@ -0,0 +1,315 @@
+package mtp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// transactionIO runs the MTP bulk-transfer state machine against a
+// Transport. DeviceDirect and DeviceGoUSB each build one of these per
+// call instead of keeping their own copies of sendReq/fetchPacket/
+// decodeRep/bulkWrite/bulkRead/runTransaction, so the state machine
+// exists in exactly one place regardless of which backend is in use.
+type transactionIO struct {
+	transport Transport
+	session   *sessionData
+
+	debug          DebugFlags
+	separateHeader bool
+
+	// logSend/logFetch print a transferred packet when Debug.Data is
+	// set. They exist so this file doesn't need to know how a backend
+	// formats its endpoint for logging. Either may be left nil (e.g. in
+	// tests) to skip logging entirely.
+	logSend  func(data []byte)
+	logFetch func(data []byte)
+}
+
+func (t *transactionIO) sendReq(ctx context.Context, req *Container) error {
+	c := usbBulkContainer{
+		usbBulkHeader: usbBulkHeader{
+			Length:        uint32(usbHdrLen + 4*len(req.Param)),
+			Type:          USB_CONTAINER_COMMAND,
+			Code:          req.Code,
+			TransactionID: req.TransactionID,
+		},
+	}
+	for i := range req.Param {
+		c.Param[i] = req.Param[i]
+	}
+
+	var wData [usbBulkLen]byte
+	buf := bytes.NewBuffer(wData[:0])
+
+	binary.Write(buf, binary.LittleEndian, c.usbBulkHeader)
+	if err := binary.Write(buf, binary.LittleEndian, c.Param[:len(req.Param)]); err != nil {
+		panic(err)
+	}
+
+	if t.logSend != nil {
+		t.logSend(buf.Bytes())
+	}
+	_, err := t.transport.BulkOut(ctx, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// fetchPacket fetches one USB packet. The header is split off, and the
+// remainder is returned. dest should be at least 512 bytes.
+func (t *transactionIO) fetchPacket(ctx context.Context, dest []byte, header *usbBulkHeader) (rest []byte, err error) {
+	n, err := t.transport.BulkIn(ctx, dest[:t.transport.MaxPacketSize(DirectionIn)])
+	if n > 0 && t.logFetch != nil {
+		t.logFetch(dest[:n])
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(dest[:n])
+	if err = binary.Read(buf, binary.LittleEndian, header); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (t *transactionIO) decodeRep(h *usbBulkHeader, rest []byte, rep *Container) error {
+	if h.Type != USB_CONTAINER_RESPONSE {
+		return SyncError(fmt.Sprintf("got type %d (%s) in response, want CONTAINER_RESPONSE.", h.Type, USB_names[int(h.Type)]))
+	}
+
+	rep.Code = h.Code
+	rep.TransactionID = h.TransactionID
+
+	restLen := int(h.Length) - usbHdrLen
+	if restLen > len(rest) {
+		return fmt.Errorf("header specified 0x%x bytes, but have 0x%x",
+			restLen, len(rest))
+	}
+	nParam := restLen / 4
+	for i := 0; i < nParam; i++ {
+		rep.Param = append(rep.Param, byteOrder.Uint32(rest[4*i:]))
+	}
+
+	if rep.Code != RC_OK {
+		return RCError(rep.Code)
+	}
+	return nil
+}
+
+// bulkWrite returns the number of non-header bytes written.
+func (t *transactionIO) bulkWrite(ctx context.Context, hdr *usbBulkHeader, r io.Reader, size int64) (n int64, err error) {
+	packetSize := t.transport.MaxPacketSize(DirectionOut)
+	if hdr != nil {
+		if size+usbHdrLen > 0xFFFFFFFF {
+			hdr.Length = 0xFFFFFFFF
+		} else {
+			hdr.Length = uint32(size + usbHdrLen)
+		}
+
+		packetArr := make([]byte, packetSize)
+		var packet []byte
+		if t.separateHeader {
+			packet = packetArr[:usbHdrLen]
+		} else {
+			packet = packetArr[:]
+		}
+
+		buf := bytes.NewBuffer(packet[:0])
+		binary.Write(buf, byteOrder, hdr)
+		cpSize := int64(len(packet) - usbHdrLen)
+		if cpSize > size {
+			cpSize = size
+		}
+
+		_, err = io.CopyN(buf, r, cpSize)
+		if t.logSend != nil {
+			t.logSend(buf.Bytes())
+		}
+		_, err = t.transport.BulkOut(ctx, buf.Bytes())
+		if err != nil {
+			return cpSize, err
+		}
+		size -= cpSize
+		n += cpSize
+	}
+
+	var buf [rwBufSize]byte
+	var lastTransfer int
+	for size > 0 {
+		var m int
+		toread := buf[:]
+		if int64(len(toread)) > size {
+			toread = buf[:int(size)]
+		}
+
+		m, err = r.Read(toread)
+		if err != nil {
+			break
+		}
+		size -= int64(m)
+
+		if t.logSend != nil {
+			t.logSend(buf[:m])
+		}
+		lastTransfer, err = t.transport.BulkOut(ctx, buf[:m])
+		n += int64(lastTransfer)
+
+		if err != nil || lastTransfer == 0 {
+			break
+		}
+	}
+	if lastTransfer%packetSize == 0 {
+		// write a short packet just to be sure.
+		t.transport.BulkOut(ctx, buf[:0])
+	}
+
+	return n, err
+}
+
+func (t *transactionIO) bulkRead(ctx context.Context, w io.Writer) (n int64, lastPacket []byte, err error) {
+	var buf [rwBufSize]byte
+	var lastRead int
+	for {
+		toread := buf[:]
+		lastRead, err = t.transport.BulkIn(ctx, toread)
+		if err != nil {
+			break
+		}
+		if lastRead > 0 {
+			if t.logFetch != nil {
+				t.logFetch(buf[:lastRead])
+			}
+
+			w, err := w.Write(buf[:lastRead])
+			n += int64(w)
+			if err != nil {
+				break
+			}
+		}
+		if t.debug.MTP {
+			log.MTP.Debugf("bulk read 0x%x bytes.", lastRead)
+		}
+		if lastRead < len(toread) {
+			// short read.
+			break
+		}
+	}
+	packetSize := t.transport.MaxPacketSize(DirectionIn)
+	if lastRead%packetSize == 0 {
+		// This should be a null packet, but on Linux + XHCI it's actually
+		// CONTAINER_OK instead. To be liberal with the XHCI behavior, return
+		// the final packet and inspect it in the calling function.
+		var nullReadSize int
+		nullReadSize, err = t.transport.BulkIn(ctx, buf[:])
+		if t.debug.MTP {
+			log.MTP.Debugf("expected null packet, read %d bytes", nullReadSize)
+		}
+		return n, buf[:nullReadSize], err
+	}
+	return n, buf[:0], err
+}
+
+// runTransaction is the shared body of RunTransaction(Context) for both
+// DeviceDirect and DeviceGoUSB: it sends req, optionally transfers
+// src/dest, and decodes rep.
+func (t *transactionIO) runTransaction(ctx context.Context, req *Container, rep *Container,
+	dest io.Writer, src io.Reader, writeSize int64) error {
+	var finalPacket []byte
+	if t.session != nil {
+		req.SessionID = t.session.sid
+		req.TransactionID = t.session.tid
+		t.session.tid++
+	}
+
+	if t.debug.MTP {
+		log.MTP.Debugf("request %s %v\n", OC_names[int(req.Code)], req.Param)
+	}
+
+	if err := t.sendReq(ctx, req); err != nil {
+		if t.debug.MTP {
+			log.MTP.Debugf("sendreq failed: %v\n", err)
+		}
+		return err
+	}
+
+	if src != nil {
+		hdr := usbBulkHeader{
+			Type:          USB_CONTAINER_DATA,
+			Code:          req.Code,
+			Length:        uint32(writeSize),
+			TransactionID: req.TransactionID,
+		}
+
+		_, err := t.bulkWrite(ctx, &hdr, src, writeSize)
+		if err != nil {
+			return err
+		}
+	}
+	fetchPacketSize := t.transport.MaxPacketSize(DirectionIn)
+	data := make([]byte, fetchPacketSize)
+	h := &usbBulkHeader{}
+	rest, err := t.fetchPacket(ctx, data[:], h)
+	if err != nil {
+		return err
+	}
+	var unexpectedData bool
+	if h.Type == USB_CONTAINER_DATA {
+		if dest == nil {
+			dest = &NullWriter{}
+			unexpectedData = true
+			if t.debug.MTP {
+				log.MTP.Debugf("discarding unexpected data 0x%x bytes", h.Length)
+			}
+		}
+		if t.debug.MTP {
+			log.MTP.Debugf("data 0x%x bytes", h.Length)
+		}
+
+		dest.Write(rest)
+
+		if len(rest)+usbHdrLen == fetchPacketSize {
+			// If this was a full packet, read until we
+			// have a short read.
+			_, finalPacket, err = t.bulkRead(ctx, dest)
+			if err != nil {
+				return err
+			}
+		}
+
+		h = &usbBulkHeader{}
+		if len(finalPacket) > 0 {
+			if t.debug.MTP {
+				log.MTP.Errorf("reusing final packet")
+			}
+			rest = finalPacket
+			finalBuf := bytes.NewBuffer(finalPacket[:len(finalPacket)])
+			err = binary.Read(finalBuf, binary.LittleEndian, h)
+		} else {
+			rest, err = t.fetchPacket(ctx, data[:], h)
+		}
+	}
+
+	err = t.decodeRep(h, rest, rep)
+	if t.debug.MTP {
+		log.MTP.Debugf("response %s %v", getName(RC_names, int(rep.Code)), rep.Param)
+	}
+	if unexpectedData {
+		return SyncError(fmt.Sprintf("unexpected data for code %s", getName(RC_names, int(req.Code))))
+	}
+
+	if err != nil {
+		return err
+	}
+	if t.session != nil && rep.TransactionID != req.TransactionID {
+		return SyncError(fmt.Sprintf("transaction ID mismatch got %x want %x",
+			rep.TransactionID, req.TransactionID))
+	}
+	rep.SessionID = req.SessionID
+	return nil
+}
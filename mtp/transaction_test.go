@@ -0,0 +1,102 @@
+package mtp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+)
+
+// stubTransport is a minimal Transport used to drive transactionIO
+// directly, without pulling in mtp/mtptest.FakeTransport: mtp/mtptest
+// imports mtp (for Transport/EndpointDirection), so an internal test in
+// package mtp can't import it back without a cycle.
+type stubTransport struct {
+	out [][]byte // recorded BulkOut payloads
+	in  [][]byte // BulkIn replies, consumed in order
+
+	maxPacketSize int
+}
+
+func (s *stubTransport) BulkOut(ctx context.Context, p []byte) (int, error) {
+	cp := append([]byte(nil), p...)
+	s.out = append(s.out, cp)
+	return len(p), nil
+}
+
+func (s *stubTransport) BulkIn(ctx context.Context, p []byte) (int, error) {
+	if len(s.in) == 0 {
+		return 0, nil
+	}
+	data := s.in[0]
+	s.in = s.in[1:]
+	return copy(p, data), nil
+}
+
+func (s *stubTransport) InterruptIn(ctx context.Context, p []byte) (int, error) {
+	return 0, nil
+}
+
+func (s *stubTransport) MaxPacketSize(dir EndpointDirection) int {
+	return s.maxPacketSize
+}
+
+func (s *stubTransport) Reset() error { return nil }
+func (s *stubTransport) Close() error { return nil }
+
+func encodeContainer(typ uint16, code uint16, tid uint32, params ...uint32) []byte {
+	c := usbBulkContainer{
+		usbBulkHeader: usbBulkHeader{
+			Length:        uint32(usbHdrLen + 4*len(params)),
+			Type:          typ,
+			Code:          code,
+			TransactionID: tid,
+		},
+	}
+	copy(c.Param[:], params)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, c.usbBulkHeader)
+	binary.Write(&buf, binary.LittleEndian, c.Param[:len(params)])
+	return buf.Bytes()
+}
+
+func TestRunTransactionNoData(t *testing.T) {
+	transport := &stubTransport{
+		maxPacketSize: 512,
+		in:            [][]byte{encodeContainer(USB_CONTAINER_RESPONSE, RC_OK, 7)},
+	}
+	tio := &transactionIO{transport: transport}
+
+	req := &Container{Code: OC_GetDeviceInfo, TransactionID: 7}
+	var rep Container
+	if err := tio.runTransaction(context.Background(), req, &rep, nil, nil, 0); err != nil {
+		t.Fatalf("runTransaction: %v", err)
+	}
+	if rep.Code != RC_OK {
+		t.Errorf("rep.Code = %x, want RC_OK", rep.Code)
+	}
+	if len(transport.out) != 1 {
+		t.Fatalf("got %d BulkOut calls, want 1", len(transport.out))
+	}
+}
+
+func TestRunTransactionSessionIDs(t *testing.T) {
+	transport := &stubTransport{
+		maxPacketSize: 512,
+		in:            [][]byte{encodeContainer(USB_CONTAINER_RESPONSE, RC_OK, 1)},
+	}
+	session := &sessionData{sid: 3, tid: 1}
+	tio := &transactionIO{transport: transport, session: session}
+
+	req := &Container{Code: OC_GetDeviceInfo}
+	var rep Container
+	if err := tio.runTransaction(context.Background(), req, &rep, nil, nil, 0); err != nil {
+		t.Fatalf("runTransaction: %v", err)
+	}
+	if req.SessionID != 3 || req.TransactionID != 1 {
+		t.Errorf("req = %+v, want SessionID=3 TransactionID=1", req)
+	}
+	if session.tid != 2 {
+		t.Errorf("session.tid = %d, want 2 (incremented)", session.tid)
+	}
+}
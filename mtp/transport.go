@@ -0,0 +1,45 @@
+package mtp
+
+import "context"
+
+// EndpointDirection selects which bulk endpoint MaxPacketSize reports on.
+type EndpointDirection int
+
+const (
+	DirectionOut EndpointDirection = iota
+	DirectionIn
+)
+
+// Transport abstracts the USB primitives the MTP transaction state
+// machine (see transaction.go) needs, so that state machine doesn't
+// have to be written against a specific USB backend. LibusbTransport and
+// GousbTransport adapt the two backends this package vendors;
+// mtp/mtptest.FakeTransport replays a pre-recorded sequence of USB
+// transfers (it does not capture live traffic) so the state machine can
+// be exercised in tests without any real USB stack.
+//
+// Every transfer method takes a ctx instead of a plain timeout so that
+// backends capable of it (GousbTransport, via gousb's native
+// libusb_cancel_transfer support) can abort an in-flight transfer the
+// instant ctx is cancelled. LibusbTransport has no such primitive; see
+// its doc comment for the resulting limitation.
+type Transport interface {
+	// BulkOut writes p to the bulk OUT endpoint, returning the number
+	// of bytes written.
+	BulkOut(ctx context.Context, p []byte) (int, error)
+	// BulkIn reads from the bulk IN endpoint into p, returning the
+	// number of bytes read.
+	BulkIn(ctx context.Context, p []byte) (int, error)
+	// InterruptIn reads an event from the interrupt IN endpoint into p.
+	InterruptIn(ctx context.Context, p []byte) (int, error)
+	// MaxPacketSize returns wMaxPacketSize of the bulk endpoint in the
+	// given direction.
+	MaxPacketSize(dir EndpointDirection) int
+	// Reset issues a USB port reset.
+	Reset() error
+	// Close releases what the transport holds. LibusbTransport closes
+	// the device handle (DeviceDirect.Close releases the claimed
+	// interface before calling it); GousbTransport releases the
+	// interface and its configuration and leaves the gousb.Device open.
+	Close() error
+}
@@ -0,0 +1,83 @@
+package mtp
+
+import (
+	"context"
+	"time"
+
+	"github.com/hanwen/usb"
+)
+
+// LibusbTransport implements Transport over hanwen/usb, i.e. the
+// behavior DeviceDirect has always had.
+//
+// hanwen/usb's BulkTransfer/InterruptTransfer are synchronous C calls
+// with no cancellation primitive of their own, so a ctx without a
+// deadline that's cancelled mid-transfer can't interrupt it: such a ctx
+// maps to a timeout of 0, which libusb treats as no timeout, and the
+// call only returns once the transfer completes or fails. A ctx
+// deadline, on the other hand, is honored up front by becoming the
+// transfer's timeout. Either way, LibusbTransport never starts a
+// transfer once ctx is already done, so callers never race a concurrent
+// abort against an in-flight libusb_bulk_transfer.
+type LibusbTransport struct {
+	h   *usb.DeviceHandle
+	dev *usb.Device
+
+	sendEP  byte
+	fetchEP byte
+	eventEP byte
+}
+
+func (t *LibusbTransport) timeoutMillis(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	dl, ok := ctx.Deadline()
+	if !ok {
+		return 0, nil
+	}
+	ms := int(time.Until(dl) / time.Millisecond)
+	if ms <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+	return ms, nil
+}
+
+func (t *LibusbTransport) BulkOut(ctx context.Context, p []byte) (int, error) {
+	ms, err := t.timeoutMillis(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return t.h.BulkTransfer(t.sendEP, p, ms)
+}
+
+func (t *LibusbTransport) BulkIn(ctx context.Context, p []byte) (int, error) {
+	ms, err := t.timeoutMillis(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return t.h.BulkTransfer(t.fetchEP, p, ms)
+}
+
+func (t *LibusbTransport) InterruptIn(ctx context.Context, p []byte) (int, error) {
+	ms, err := t.timeoutMillis(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return t.h.InterruptTransfer(t.eventEP, p, ms)
+}
+
+func (t *LibusbTransport) MaxPacketSize(dir EndpointDirection) int {
+	if dir == DirectionOut {
+		return t.dev.GetMaxPacketSize(t.sendEP)
+	}
+	return t.dev.GetMaxPacketSize(t.fetchEP)
+}
+
+func (t *LibusbTransport) Reset() error {
+	return t.h.Reset()
+}
+
+func (t *LibusbTransport) Close() error {
+	return t.h.Close()
+}
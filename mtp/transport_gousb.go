@@ -0,0 +1,59 @@
+package mtp
+
+import (
+	"context"
+
+	"github.com/google/gousb"
+)
+
+// GousbTransport implements Transport over gousb, i.e. the behavior
+// DeviceGoUSB has always had. gousb's endpoints support context-based
+// cancellation directly (libusb_cancel_transfer under the hood), so
+// BulkOut/BulkIn/InterruptIn pass ctx straight through instead of
+// deriving their own independent one: a caller's ctx being cancelled
+// aborts the in-flight transfer immediately rather than waiting it out.
+type GousbTransport struct {
+	dev *gousb.Device
+
+	// cfg/iface are released by Close. They're set once in Open,
+	// alongside sendEP/fetchEP/eventEP.
+	cfg   *gousb.Config
+	iface *gousb.Interface
+
+	sendEP  *gousb.OutEndpoint
+	fetchEP *gousb.InEndpoint
+	eventEP *gousb.InEndpoint
+}
+
+func (t *GousbTransport) BulkOut(ctx context.Context, p []byte) (int, error) {
+	return t.sendEP.WriteContext(ctx, p)
+}
+
+func (t *GousbTransport) BulkIn(ctx context.Context, p []byte) (int, error) {
+	return t.fetchEP.ReadContext(ctx, p)
+}
+
+func (t *GousbTransport) InterruptIn(ctx context.Context, p []byte) (int, error) {
+	return t.eventEP.ReadContext(ctx, p)
+}
+
+func (t *GousbTransport) MaxPacketSize(dir EndpointDirection) int {
+	if dir == DirectionOut {
+		return t.sendEP.Desc.MaxPacketSize
+	}
+	return t.fetchEP.Desc.MaxPacketSize
+}
+
+func (t *GousbTransport) Reset() error {
+	return t.dev.Reset()
+}
+
+func (t *GousbTransport) Close() error {
+	if t.iface != nil {
+		t.iface.Close()
+	}
+	if t.cfg != nil {
+		return t.cfg.Close()
+	}
+	return nil
+}